@@ -0,0 +1,76 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+)
+
+// aesKeySize is the size, in bytes, of an AES-256 key.
+const aesKeySize = 32
+
+// encryptionKey is a random AES-256-GCM key generated per upload. improut
+// never persists it: it's only ever handed back to the uploader, via the
+// URL fragment (or the ?k= query fallback), so only someone holding the
+// link can decrypt the file.
+type encryptionKey [aesKeySize]byte
+
+func newEncryptionKey() (encryptionKey, error) {
+	var key encryptionKey
+	_, err := rand.Read(key[:])
+	return key, err
+}
+
+func (k encryptionKey) String() string {
+	return base64.RawURLEncoding.EncodeToString(k[:])
+}
+
+func parseEncryptionKey(s string) (encryptionKey, error) {
+	var key encryptionKey
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return key, err
+	}
+	if len(raw) != aesKeySize {
+		return key, errors.New("invalid encryption key length")
+	}
+	copy(key[:], raw)
+	return key, nil
+}
+
+func newGCM(key encryptionKey) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key[:])
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// encryptBlob seals plaintext under a fresh random nonce and returns
+// nonce||ciphertext, ready to be written to storage as-is.
+func encryptBlob(key encryptionKey, plaintext []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// decryptBlob reverses encryptBlob, given the same nonce||ciphertext layout.
+func decryptBlob(key encryptionKey, blob []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(blob) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, ciphertext := blob[:gcm.NonceSize()], blob[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
@@ -2,13 +2,13 @@ package main
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/cespare/xxhash"
-	"github.com/pkg/xattr"
 	"io"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
@@ -16,6 +16,7 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -34,6 +35,7 @@ type lutimUploadReplyMessage struct {
 	DeleteFirstView bool   `json:"del_at_view"`
 	FileExtension   string `json:"ext"`
 	LifetimeDays    int    `json:"limit"`
+	Encrypted       bool   `json:"encrypted"`
 }
 
 type lutimDeleteReply struct {
@@ -41,31 +43,73 @@ type lutimDeleteReply struct {
 	Msg     string `json:"msg"`
 }
 
+// pomfUploadReply is the Pomf-standard multi-file upload response, see
+// https://github.com/pomf/pomf/blob/master/README.md#api
+type pomfUploadReply struct {
+	Success bool               `json:"success"`
+	Files   []pomfUploadedFile `json:"files"`
+}
+
+type pomfUploadedFile struct {
+	Hash string `json:"hash"`
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	Size int64  `json:"size"`
+}
+
 type options struct {
 	LifetimeDays int
+	MaxDownloads int
+	Encrypt      bool
 }
 
 type storedFile struct {
 	Name          string
 	Expires       *time.Time
 	DeletionToken string
+	// EncryptionKey is set when the upload was encrypted at rest; it must
+	// be handed back to the caller (in the URL fragment) since improut
+	// itself never stores it.
+	EncryptionKey string
+	SHA256Sum     string
+	Size          int64
 }
 
 const (
-	kExpiresXAttr       = "user.imp.expire"
-	kDeletionTokenXAttr = "user.imp.dtoken"
+	kDeletionTokenHeader      = "X-Deletion-Token"
+	kMaxDownloadsHeader       = "Max-Downloads"
+	kRemainingDownloadsHeader = "X-Remaining-Downloads"
+	kEncryptHeader            = "X-Encrypt"
 
-	kDeletionTokenHeader = "X-Deletion-Token"
+	kLutimLifetimeArg     = "delete-day"
+	kLutimFirstViewArg    = "first-view"
+	kLutimMaxDownloadsArg = "max-downloads"
+	kLutimEncryptArg      = "encrypt"
 
-	kLutimLifetimeArg = "delete-day"
+	kEncryptionKeyQueryArg = "k"
 
 	kGitUrl = "https://github.com/zopieux/improut"
+
+	kPomfPath       = "/upload.php"
+	kPomfFilesField = "files[]"
 )
 
+// blobMu guards every get-modify-put sequence over a blob's FileMetadata
+// (storeFile, deleteFile, recordDownload, checkExpired, and archiveBrowse's
+// listing cache write-back), so an upload, a deletion and a
+// download-count decrement on the same shared blob can't race on a stale
+// read and silently drop each other's update.
+var blobMu sync.Mutex
+
+// kExtPattern matches a stored file's extension. Most uploads keep a plain
+// 1-8 character extension, but archive uploads (see archive.go) can carry a
+// compound one like ".tar.gz" or ".tar.bz2".
+const kExtPattern = `[a-z0-9]{1,8}(?:\.[a-z0-9]{1,8})?`
 
 var (
-	kNameRegexp        = regexp.MustCompile("^[a-f0-9]{16}\\.[a-z]{3,5}$")
-	kLutimDeleteRegexp = regexp.MustCompile("/d/([a-f0-9]{16}\\.[a-z]{3,5})/([a-f0-9]{32})$")
+	kNameRegexp        = regexp.MustCompile(`^[a-f0-9]{32}\.` + kExtPattern + `$`)
+	kLutimDeleteRegexp = regexp.MustCompile(`/d/([a-f0-9]{32}\.` + kExtPattern + `)/([a-f0-9]{32})$`)
+	kArchiveRegexp     = regexp.MustCompile(`^([a-f0-9]{32}\.(?:zip|tar|tar\.gz|tar\.bz2))/(.*)$`)
 )
 
 func storageName(name string) string {
@@ -79,8 +123,19 @@ func storageNameFromRequest(r *http.Request) string {
 	return storageName(strings.TrimLeft(r.URL.Path, "/"))
 }
 
-func storagePath(storageName string) string {
-	return filepath.Join(*storageRoot, storageName)
+// fileExt returns the on-disk extension to use for originalName, lowercased
+// since the stored filename must match kNameRegexp/kArchiveRegexp (both
+// [a-z0-9] only). It's the same as filepath.Ext, except for .tar.gz and
+// .tar.bz2, which are kept whole so archive browsing (see archive.go) can
+// tell a tarball apart from a plain .gz or .bz2 upload.
+func fileExt(originalName string) string {
+	lower := strings.ToLower(originalName)
+	for _, compound := range []string{".tar.gz", ".tar.bz2"} {
+		if strings.HasSuffix(lower, compound) {
+			return compound
+		}
+	}
+	return strings.ToLower(filepath.Ext(originalName))
 }
 
 func storeFile(file io.ReadCloser, originalName string, opts *options) (storedFile, error) {
@@ -90,7 +145,7 @@ func storeFile(file io.ReadCloser, originalName string, opts *options) (storedFi
 		return storedFile{}, err
 	}
 
-	tempPath := storagePath(".tmp-" + hex.EncodeToString(randBytes))
+	tempPath := filepath.Join(os.TempDir(), "improut-put-"+hex.EncodeToString(randBytes))
 	defer func() { os.Remove(tempPath) }()
 	if err := func() error {
 		dst, err := os.Create(tempPath)
@@ -106,63 +161,168 @@ func storeFile(file io.ReadCloser, originalName string, opts *options) (storedFi
 		return storedFile{}, err
 	}
 
-	ok := false
-	digest := xxhash.New()
+	var encryptionKeyStr string
+	var plainMimeType string
+	if opts.Encrypt {
+		// GCM can't validate authenticity until the whole ciphertext has
+		// been read, so - same as the S3 backend already does for its
+		// own reasons - we buffer through the temp file rather than
+		// encrypt as we stream.
+		plaintext, err := ioutil.ReadFile(tempPath)
+		if err != nil {
+			return storedFile{}, err
+		}
+		plainMimeType = http.DetectContentType(plaintext)
+		key, err := newEncryptionKey()
+		if err != nil {
+			return storedFile{}, err
+		}
+		blob, err := encryptBlob(key, plaintext)
+		if err != nil {
+			return storedFile{}, err
+		}
+		if err := ioutil.WriteFile(tempPath, blob, 0600); err != nil {
+			return storedFile{}, err
+		}
+		encryptionKeyStr = key.String()
+	}
+
+	// The digest doubles as both the dedup key and the SHA-256 we record
+	// for callers, so it must be collision-resistant: a 16-byte (32 hex
+	// char) prefix of SHA-256, not a fast non-cryptographic hash like
+	// xxhash, since a crafted collision there could hijack or delete
+	// someone else's upload.
+	sum := sha256.New()
 	file2, err := os.Open(tempPath)
 	if err != nil {
 		return storedFile{}, err
 	}
 	defer file2.Close()
-	if _, err := io.Copy(digest, file2); err != nil {
+	if _, err := io.Copy(sum, file2); err != nil {
 		return storedFile{}, err
 	}
 	file2.Close()
-	ext := filepath.Ext(originalName)
+	ext := fileExt(originalName)
 	if len(ext) == 0 {
 		ext = ".jpg"
 	}
-	name := hex.EncodeToString(digest.Sum(nil)) + ext
-	path := storagePath(name)
-	if err := os.Rename(tempPath, path); err != nil {
-		return storedFile{}, err
-	}
+	digest := sum.Sum(nil)
+	name := hex.EncodeToString(digest[:16]) + ext
 
-	defer func() {
-		if !ok {
-			os.Remove(path)
-		}
-	}()
-	if err := xattr.Set(path, kDeletionTokenXAttr, randBytes); err != nil {
-		return storedFile{}, err
-	}
+	entry := UploadEntry{DeleteKey: hex.EncodeToString(randBytes), CreatedAt: time.Now()}
 	var expires *time.Time = nil
 	if opts.LifetimeDays > 0 {
 		t := time.Now().Add(time.Hour * 24 * time.Duration(opts.LifetimeDays))
-		expiresBin, err := t.MarshalBinary()
+		entry.Expiry = t
+		expires = &t
+	}
+	if opts.MaxDownloads > 0 {
+		entry.MaxDownloads = opts.MaxDownloads
+		entry.DownloadsRemaining = opts.MaxDownloads
+	}
+
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	meta, err := metaStore.Get(name)
+	if err != nil {
+		// First upload of this content: actually write the bytes and
+		// seed fresh metadata. A later upload of the same content will
+		// find this metadata and just add its own UploadEntry below.
+		ok := false
+		content, err := os.Open(tempPath)
 		if err != nil {
 			return storedFile{}, err
 		}
-		if err := xattr.Set(path, kExpiresXAttr, expiresBin); err != nil {
+		defer content.Close()
+		mimeType := plainMimeType
+		if !opts.Encrypt {
+			sniff := make([]byte, 512)
+			n, err := content.Read(sniff)
+			if err != nil && err != io.EOF {
+				return storedFile{}, err
+			}
+			mimeType = http.DetectContentType(sniff[:n])
+			if _, err := content.Seek(0, io.SeekStart); err != nil {
+				return storedFile{}, err
+			}
+		}
+		size, err := backend.Put(name, content)
+		if err != nil {
 			return storedFile{}, err
 		}
-		expires = &t
-	} else {
-		_ = xattr.Remove(path, kExpiresXAttr)
+		defer func() {
+			if !ok {
+				backend.Delete(name)
+			}
+		}()
+		meta = &FileMetadata{
+			SHA256Sum:        hex.EncodeToString(digest),
+			MimeType:         mimeType,
+			Size:             size,
+			OriginalFilename: originalName,
+			Encrypted:        opts.Encrypt,
+		}
+		ok = true
 	}
-	ok = true
-	log.Printf("Stored file %s (%+v)", path, opts)
-	return storedFile{Name: name, Expires: expires, DeletionToken: hex.EncodeToString(randBytes)}, nil
+	meta.Uploads = append(meta.Uploads, entry)
+	if err := metaStore.Put(name, meta); err != nil {
+		return storedFile{}, err
+	}
+	log.Printf("Stored file %s (%+v)", name, opts)
+	return storedFile{
+		Name:          name,
+		Expires:       expires,
+		DeletionToken: entry.DeleteKey,
+		EncryptionKey: encryptionKeyStr,
+		SHA256Sum:     meta.SHA256Sum,
+		Size:          meta.Size,
+	}, nil
+}
+
+// deleteBlob removes name's stored bytes and metadata outright. Callers must
+// only reach for this once a blob's last UploadEntry is gone: deleteFile,
+// checkExpired, and dispatch once recordDownload reports that the download
+// limit emptied the blob.
+func deleteBlob(name string) error {
+	if err := backend.Delete(name); err != nil {
+		return err
+	}
+	_ = metaStore.Delete(name)
+	return nil
 }
 
-func deleteFile(path string, userDeletionToken string) error {
-	deletionToken, err := xattr.Get(path, kDeletionTokenXAttr)
-	if err != nil || userDeletionToken != hex.EncodeToString(deletionToken) {
+func deleteFile(name string, userDeletionToken string) error {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+
+	meta, err := metaStore.Get(name)
+	if err != nil {
+		return errors.New("no such file or invalid token")
+	}
+	idx := -1
+	for i, e := range meta.Uploads {
+		if e.DeleteKey == userDeletionToken {
+			idx = i
+			break
+		}
+	}
+	if idx == -1 {
 		return errors.New("no such file or invalid token")
 	}
-	if err := os.Remove(path); err == nil {
-		log.Printf("Deleted file %s", path)
+	meta.Uploads = append(meta.Uploads[:idx], meta.Uploads[idx+1:]...)
+	if len(meta.Uploads) > 0 {
+		if err := metaStore.Put(name, meta); err != nil {
+			return err
+		}
+		log.Printf("Deleted upload entry for file %s (%d remaining)", name, len(meta.Uploads))
+		return nil
+	}
+	if err := deleteBlob(name); err != nil {
+		return err
 	}
-	return err
+	log.Printf("Deleted file %s (last upload entry removed)", name)
+	return nil
 }
 
 func parseLifetimeDays(request *http.Request) int {
@@ -176,6 +336,114 @@ func parseLifetimeDays(request *http.Request) int {
 	return lifetimeDays
 }
 
+func parseMaxDownloadsForm(request *http.Request) int {
+	if request.FormValue(kLutimFirstViewArg) == "1" {
+		return 1
+	}
+	if n, err := strconv.Atoi(request.FormValue(kLutimMaxDownloadsArg)); err == nil && n > 0 {
+		return n
+	}
+	return 0
+}
+
+func parseMaxDownloadsHeader(request *http.Request) int {
+	n, err := strconv.Atoi(request.Header.Get(kMaxDownloadsHeader))
+	if err != nil || n <= 0 {
+		return 0
+	}
+	return n
+}
+
+func parseEncryptForm(request *http.Request) bool {
+	return *forceEncrypt || request.FormValue(kLutimEncryptArg) == "1"
+}
+
+func parseEncryptHeader(request *http.Request) bool {
+	return *forceEncrypt || request.Header.Get(kEncryptHeader) == "1"
+}
+
+// recordDownload decrements the remaining download count of every
+// view-limited UploadEntry sharing name's blob - a single request serves
+// the same bytes regardless of which uploader's link reached it, so each
+// uploader's own budget is charged independently and an entry with no
+// limit is never touched. It returns the lowest DownloadsRemaining left
+// across those entries, or -1 if none of them have a limit, so callers
+// know whether to set X-Remaining-Downloads. expired reports that every
+// entry is now gone; deleting the blob itself is left to the caller, since
+// it must happen after the content has actually been served.
+func recordDownload(name string) (remaining int, expired bool, err error) {
+	blobMu.Lock()
+	defer blobMu.Unlock()
+	meta, err := metaStore.Get(name)
+	if err != nil {
+		return -1, false, err
+	}
+	remaining = -1
+	kept := meta.Uploads[:0]
+	for _, e := range meta.Uploads {
+		if e.MaxDownloads > 0 {
+			e.DownloadsRemaining--
+			if remaining < 0 || e.DownloadsRemaining < remaining {
+				remaining = e.DownloadsRemaining
+			}
+			if e.DownloadsRemaining <= 0 {
+				continue
+			}
+		}
+		kept = append(kept, e)
+	}
+	if len(kept) == 0 {
+		return remaining, true, nil
+	}
+	meta.Uploads = kept
+	if err := metaStore.Put(name, meta); err != nil {
+		return remaining, false, err
+	}
+	return remaining, false, nil
+}
+
+// serveEncrypted serves an encrypted file at name. The server never sees the
+// URL fragment carrying the decryption key, so it has two ways to hand back
+// something useful: a tiny client-side viewer for browsers (text/html), or,
+// for the ?k= query fallback used by plain HTTP clients like curl, decrypt
+// the content itself. Absent either, it serves the raw ciphertext, which is
+// what the viewer's own fetch() call expects.
+func serveEncrypted(writer http.ResponseWriter, request *http.Request, name string, meta *FileMetadata) {
+	if strings.Contains(request.Header.Get("Accept"), "text/html") {
+		writer.Header().Set("Content-Type", "text/html; charset=utf-8")
+		writer.Write([]byte(encryptedViewerHTML(meta.MimeType)))
+		return
+	}
+	if keyParam := request.URL.Query().Get(kEncryptionKeyQueryArg); keyParam != "" {
+		key, err := parseEncryptionKey(keyParam)
+		if err != nil {
+			http.Error(writer, "invalid decryption key", http.StatusBadRequest)
+			return
+		}
+		r, err := backend.Get(name)
+		if err != nil {
+			http.NotFound(writer, request)
+			return
+		}
+		defer r.Close()
+		blob, err := ioutil.ReadAll(r)
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		plaintext, err := decryptBlob(key, blob)
+		if err != nil {
+			http.Error(writer, "decryption failed", http.StatusBadRequest)
+			return
+		}
+		writer.Header().Set("Content-Type", meta.MimeType)
+		writer.Write(plaintext)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/octet-stream")
+	backend.ServeFile(name, writer, request)
+}
+
 func lutimUpload(writer http.ResponseWriter, request *http.Request) {
 	if err := request.ParseMultipartForm(*maxFileSize); err != nil {
 		http.Error(writer, err.Error(), http.StatusBadRequest)
@@ -187,23 +455,30 @@ func lutimUpload(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 	lifetimeDays := parseLifetimeDays(request)
-	stored, err := storeFile(file, hdr.Filename, &options{LifetimeDays: lifetimeDays})
+	maxDownloads := parseMaxDownloadsForm(request)
+	encrypt := parseEncryptForm(request)
+	stored, err := storeFile(file, hdr.Filename, &options{LifetimeDays: lifetimeDays, MaxDownloads: maxDownloads, Encrypt: encrypt})
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	realShort := stored.Name
+	if stored.EncryptionKey != "" {
+		realShort += "#k=" + stored.EncryptionKey
+	}
 	reply, err := json.Marshal(lutimUploadReply{
 		Success: true,
 		Message: lutimUploadReplyMessage{
-			RealShort:       stored.Name,
+			RealShort:       realShort,
 			Short:           stored.Name,
 			Token:           stored.DeletionToken,
 			Thumb:           "",
 			Filename:        hdr.Filename,
 			CreatedAt:       time.Now().Unix(),
-			DeleteFirstView: false,
+			DeleteFirstView: maxDownloads == 1,
 			FileExtension:   filepath.Ext(stored.Name),
 			LifetimeDays:    lifetimeDays,
+			Encrypted:       stored.EncryptionKey != "",
 		},
 	})
 	if err != nil {
@@ -225,7 +500,7 @@ func lutimDelete(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 	deletionToken := match[2]
-	deleteErr := deleteFile(storagePath(name), deletionToken)
+	deleteErr := deleteFile(name, deletionToken)
 	reply, err := json.Marshal(lutimDeleteReply{
 		Success: deleteErr == nil,
 		Msg: func() string {
@@ -258,7 +533,9 @@ func restUpload(writer http.ResponseWriter, request *http.Request) {
 		return
 	}
 	lifetimeDays := parseLifetimeDays(request)
-	stored, err := storeFile(file, hdr.Filename, &options{LifetimeDays: lifetimeDays})
+	maxDownloads := parseMaxDownloadsHeader(request)
+	encrypt := parseEncryptHeader(request)
+	stored, err := storeFile(file, hdr.Filename, &options{LifetimeDays: lifetimeDays, MaxDownloads: maxDownloads, Encrypt: encrypt})
 	if err != nil {
 		http.Error(writer, err.Error(), http.StatusInternalServerError)
 		return
@@ -267,7 +544,92 @@ func restUpload(writer http.ResponseWriter, request *http.Request) {
 	if stored.Expires != nil {
 		writer.Header().Set("Expires", stored.Expires.Format(http.TimeFormat))
 	}
-	http.Redirect(writer, request, "/"+stored.Name, 302)
+	location := "/" + stored.Name
+	if stored.EncryptionKey != "" {
+		location += "#k=" + stored.EncryptionKey
+	}
+	http.Redirect(writer, request, location, 302)
+}
+
+// requestBaseURL reconstructs the scheme://host improut was reached on, so
+// Pomf-style replies can return absolute URLs as the spec requires, unlike
+// the relative paths the rest of improut's API is happy to hand back.
+func requestBaseURL(request *http.Request) string {
+	scheme := "http"
+	if request.TLS != nil {
+		scheme = "https"
+	}
+	if proto := request.Header.Get("X-Forwarded-Proto"); proto != "" {
+		scheme = proto
+	}
+	return scheme + "://" + request.Host
+}
+
+// pomfUpload implements the Pomf-standard multi-file upload endpoint, so
+// improut is a drop-in target for the ShareX / Pomf client ecosystem.
+func pomfUpload(writer http.ResponseWriter, request *http.Request) {
+	if err := request.ParseMultipartForm(*maxFileSize); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	headers := request.MultipartForm.File[kPomfFilesField]
+	if len(headers) == 0 {
+		http.Error(writer, "missing "+kPomfFilesField, http.StatusBadRequest)
+		return
+	}
+	lifetimeDays := parseLifetimeDays(request)
+	maxDownloads := parseMaxDownloadsForm(request)
+	encrypt := parseEncryptForm(request)
+	baseURL := requestBaseURL(request)
+
+	files := make([]pomfUploadedFile, 0, len(headers))
+	for _, hdr := range headers {
+		file, err := hdr.Open()
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		stored, err := storeFile(file, hdr.Filename, &options{LifetimeDays: lifetimeDays, MaxDownloads: maxDownloads, Encrypt: encrypt})
+		if err != nil {
+			http.Error(writer, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		url := baseURL + "/" + stored.Name
+		if stored.EncryptionKey != "" {
+			url += "#k=" + stored.EncryptionKey
+		}
+		files = append(files, pomfUploadedFile{
+			Hash: stored.SHA256Sum,
+			Name: hdr.Filename,
+			URL:  url,
+			Size: stored.Size,
+		})
+	}
+
+	reply, err := json.Marshal(pomfUploadReply{Success: true, Files: files})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Write(reply)
+}
+
+// pomfInfo serves GET /upload.php, a lutimInfo-style capability document
+// for Pomf-standard clients: the max size they can upload, and which
+// extensions are allowed (improut doesn't restrict any).
+func pomfInfo(writer http.ResponseWriter, request *http.Request) {
+	reply, err := json.Marshal(struct {
+		MaxFileSize       int64    `json:"max_upload_size"`
+		AllowedExtensions []string `json:"allowed_extensions"`
+	}{
+		MaxFileSize:       *maxFileSize,
+		AllowedExtensions: []string{},
+	})
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Write(reply)
 }
 
 func restDelete(writer http.ResponseWriter, request *http.Request) {
@@ -276,7 +638,7 @@ func restDelete(writer http.ResponseWriter, request *http.Request) {
 		http.NotFound(writer, request)
 		return
 	}
-	if err := deleteFile(storagePath(name), request.Header.Get(kDeletionTokenHeader)); err != nil {
+	if err := deleteFile(name, request.Header.Get(kDeletionTokenHeader)); err != nil {
 		http.NotFound(writer, request)
 		return
 	}
@@ -286,46 +648,93 @@ func restDelete(writer http.ResponseWriter, request *http.Request) {
 func dispatch(writer http.ResponseWriter, request *http.Request) {
 	switch request.Method {
 	case http.MethodGet:
+		if request.URL.Path == kPomfPath {
+			pomfInfo(writer, request)
+			return
+		}
 		if request.URL.Path == "/" {
 			writer.Write([]byte(fmt.Sprintf(`
 improut ⋅ dead simple image hosting
 
 Upload:
-  $ curl -v -F file=@image.png [ -F delete-day=<lifetime in days> ] /
+  $ curl -v -F file=@image.png [ -F delete-day=<lifetime in days> ] [ -H '%s: <views>' ] [ -H '%s: 1' ] /
 	Returns a 302 redirect to the image, with %s header for deletion.
+	Encrypted uploads get a #k=<key> fragment appended; keep it secret.
 
   or (Lutim compatibility):
-  $ curl -v -F file=@image.png -F format=json [ -F delete-day=<lifetime in days> ] /
+  $ curl -v -F file=@image.png -F format=json [ -F delete-day=<lifetime in days> ] [ -F first-view=1 | -F max-downloads=<views> ] [ -F encrypt=1 ] /
 	Returns a JSON reply which includes the deletion token.
 
+  or (Pomf compatibility, for ShareX and other Pomf clients):
+  $ curl -v -F files[]=@image.png [ -F files[]=@other.png ... ] %s
+	Returns a JSON reply with one {hash, name, url, size} object per file.
+
 Delete existing image:
 	$ curl -v -X DELETE -H '%s: <token>' /<image path>
 
   or (Lutim compatibility):
 	$ curl -v /d/<image path>/<token>
 
+Browse an uploaded zip/tar/tar.gz/tar.bz2 (if -enable-archive-browse is set):
+	$ curl -v /<archive path>/
+		Returns a JSON listing of entries.
+	$ curl -v /<archive path>/<path inside>
+		Streams that single member.
+
 This is open-source software under MIT license:
 %s
-`, kDeletionTokenHeader, kDeletionTokenHeader, kGitUrl)))
+`, kMaxDownloadsHeader, kEncryptHeader, kDeletionTokenHeader, kPomfPath, kDeletionTokenHeader, kGitUrl)))
 			return
 		}
 		if kLutimDeleteRegexp.MatchString(request.URL.Path) {
 			lutimDelete(writer, request)
 			return
 		}
+		if archiveName, member, ok := archiveRequestParts(request.URL.Path); ok {
+			archiveBrowse(writer, request, archiveName, member)
+			return
+		}
 		name := storageNameFromRequest(request)
 		if name == "" {
 			http.NotFound(writer, request)
 			return
 		}
-		if *xAccel == "" {
-			http.ServeFile(writer, request, storagePath(name))
+		meta, err := metaStore.Get(name)
+		if err != nil {
+			http.NotFound(writer, request)
+			return
+		}
+		if meta.Encrypted && strings.Contains(request.Header.Get("Accept"), "text/html") {
+			// This is the browser loading the viewer page, not the
+			// page's own fetch() for the actual ciphertext, so it must
+			// not count against Max-Downloads.
+			serveEncrypted(writer, request, name, meta)
+			return
+		}
+		remaining, expired, err := recordDownload(name)
+		if err != nil {
+			log.Printf("Failed to update download count for %s: %v", name, err)
+		}
+		if remaining >= 0 {
+			writer.Header().Set(kRemainingDownloadsHeader, strconv.Itoa(remaining))
+		}
+		if meta.Encrypted {
+			serveEncrypted(writer, request, name, meta)
 		} else {
-			redirect := *xAccel + "/" + name
-			writer.Header().Set("X-Accel-Redirect", redirect)
-			writer.WriteHeader(204)
+			backend.ServeFile(name, writer, request)
+		}
+		if expired {
+			if err := deleteBlob(name); err != nil {
+				log.Printf("Failed to delete file %s: %v", name, err)
+			} else {
+				log.Printf("Deleted file %s (download limit reached)", name)
+			}
 		}
 	case http.MethodPost:
+		if request.URL.Path == kPomfPath {
+			pomfUpload(writer, request)
+			return
+		}
 		if request.URL.Path != "/" {
 			http.NotFound(writer, request)
 			return
@@ -356,7 +765,7 @@ func lutimInfo(writer http.ResponseWriter, request *http.Request) {
 		MaxDelay         int    `json:"max_delay"`
 		MaxFileSize      int64  `json:"max_file_size"`
 	}{
-		AlwaysEncrypt:    false,
+		AlwaysEncrypt:    *forceEncrypt,
 		BroadcastMessage: *lutimMotd,
 		Contact:          kGitUrl,
 		DefaultDelay:     *defaultLifetimeDays,
@@ -2,11 +2,9 @@ package main
 
 import (
 	"flag"
-	"github.com/pkg/xattr"
 	"log"
 	"net/http"
 	"os"
-	"path/filepath"
 	"time"
 )
 
@@ -18,30 +16,55 @@ var (
 	lutimMotd                = flag.String("motd", "", "Lutim: message of the day")
 	xAccel                   = flag.String("xaccel", "", "if non-empty, use X-Accel-Redirect with this root path, instead of serving files ourselves")
 	expireCheckIntervalHours = flag.Int("expire-interval", 1, "delay between two expiration checks (hours)")
-	storageRoot              = flag.String("root", "/var/lib/improut", "root storage directory")
+	storageRoot              = flag.String("root", "/var/lib/improut", "root storage directory: file bytes for the localfs backend, and metadata for the json metadata store with any backend")
+
+	storageBackendFlag = flag.String("backend", "localfs", "storage backend to use (localfs, s3)")
+	s3Bucket           = flag.String("s3-bucket", "", "s3 backend: bucket name")
+	s3Region           = flag.String("s3-region", "us-east-1", "s3 backend: region")
+	s3Endpoint         = flag.String("s3-endpoint", "", "s3 backend: custom endpoint (for S3-compatible services), empty for AWS")
+	s3ForcePathStyle   = flag.Bool("s3-force-path-style", false, "s3 backend: force path-style addressing, needed by most non-AWS S3-compatible services")
+
+	metadataStoreFlag = flag.String("metadata", "xattr", "metadata store to use (xattr, json)")
+
+	forceEncrypt = flag.Bool("force-encrypt", false, "encrypt every upload at rest, regardless of what the client asks for")
+
+	enableArchiveBrowse     = flag.Bool("enable-archive-browse", false, "allow browsing the contents of uploaded zip/tar archives via GET /<name>.<ext>/<path inside>")
+	maxArchiveEntries       = flag.Int("max-archive-entries", 10000, "max entries to list or extract from a browsable archive, guards against zip/tar bombs")
+	maxArchiveExtractedSize = flag.Int64("max-archive-extracted-size", 100<<20, "max decompressed size in bytes of a single archive member served via browsing, guards against zip/tar bombs with huge compression ratios")
 )
 
 func checkExpired() {
 	for {
 		now := time.Now()
-		var t time.Time
-		filepath.Walk(*storageRoot, func(path string, info os.FileInfo, err error) error {
-			if err != nil {
-				return nil
-			}
-			binary, err := xattr.Get(path, kExpiresXAttr)
+		keys, err := metaStore.List()
+		if err != nil {
+			log.Printf("Failed to list metadata: %v", err)
+		}
+		for _, key := range keys {
+			blobMu.Lock()
+			meta, err := metaStore.Get(key)
 			if err != nil {
-				return nil
+				blobMu.Unlock()
+				continue
 			}
-			if err := t.UnmarshalBinary(binary); err != nil {
-				return nil
+			before := len(meta.Uploads)
+			var kept []UploadEntry
+			for _, entry := range meta.Uploads {
+				if !entry.Expiry.IsZero() && entry.Expiry.Before(now) {
+					log.Printf("Dropping expired upload entry for %s (expired %v)", key, entry.Expiry)
+					continue
+				}
+				kept = append(kept, entry)
 			}
-			if t.Before(now) {
-				log.Printf("Removing file %s (expired %v, %v)", filepath.Base(path), t, t.Sub(now))
-				os.Remove(path)
+			meta.Uploads = kept
+			if len(meta.Uploads) == 0 {
+				log.Printf("Removing file %s (no upload entries left)", key)
+				deleteBlob(key)
+			} else if len(kept) != before {
+				metaStore.Put(key, meta)
 			}
-			return nil
-		})
+			blobMu.Unlock()
+		}
 		time.Sleep(time.Duration(*expireCheckIntervalHours) * 60 * 1000 * time.Millisecond)
 	}
 }
@@ -49,9 +72,22 @@ func checkExpired() {
 func main() {
 	flag.Parse()
 
-	if err := os.MkdirAll(*storageRoot, 0750); err != nil {
+	if *storageBackendFlag == "localfs" {
+		if err := os.MkdirAll(*storageRoot, 0750); err != nil {
+			log.Fatal(err)
+		}
+	}
+	b, err := newBackend()
+	if err != nil {
+		log.Fatal(err)
+	}
+	backend = b
+
+	m, err := newMetadataStore()
+	if err != nil {
 		log.Fatal(err)
 	}
+	metaStore = m
 
 	go checkExpired()
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"archive/zip"
 	"bytes"
 	"encoding/json"
 	"io/ioutil"
@@ -34,6 +35,76 @@ func TestLutimInfo(t *testing.T) {
 	}
 }
 
+func TestNewMetadataStoreRejectsXattrWithNonLocalBackend(t *testing.T) {
+	defer func(backendFlag, metadataFlag string) {
+		*storageBackendFlag = backendFlag
+		*metadataStoreFlag = metadataFlag
+	}(*storageBackendFlag, *metadataStoreFlag)
+
+	*storageBackendFlag = "s3"
+	*metadataStoreFlag = "xattr"
+	if _, err := newMetadataStore(); err != errXattrRequiresLocalFS {
+		t.Errorf("expected errXattrRequiresLocalFS, got %v", err)
+	}
+
+	*metadataStoreFlag = "json"
+	if _, err := newMetadataStore(); err != nil {
+		t.Errorf("json metadata store should work with any backend, got %v", err)
+	}
+}
+
+func TestJSONMetadataStorePutIsAtomic(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := newJSONMetadataStore(dir)
+
+	meta := &FileMetadata{SHA256Sum: "abc", Uploads: []UploadEntry{{DeleteKey: "k"}}}
+	if err := store.Put("f.png", meta); err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := store.List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(keys, []string{"f.png"}) {
+		t.Errorf("List should only see the final file, not a leftover temp file: %v", keys)
+	}
+
+	entries, err := ioutil.ReadDir(store.metaDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("Put should not leave any temp file behind, found %+v", entries)
+	}
+
+	got, err := store.Get("f.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.SHA256Sum != "abc" {
+		t.Errorf("wrong round-tripped metadata: %+v", got)
+	}
+}
+
+func TestFileExtLowercasesExtension(t *testing.T) {
+	cases := map[string]string{
+		"photo.PNG":       ".png",
+		"bundle.TAR.GZ":   ".tar.gz",
+		"archive.Tar.Bz2": ".tar.bz2",
+		"joconde.png":     ".png",
+	}
+	for name, want := range cases {
+		if got := fileExt(name); got != want {
+			t.Errorf("fileExt(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
 func TestUpload(t *testing.T) {
 	dir, err := ioutil.TempDir(".", "tmpstorage")
 	if err != nil {
@@ -41,6 +112,8 @@ func TestUpload(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
 
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
@@ -69,7 +142,7 @@ func TestUpload(t *testing.T) {
 		t.Error("empty deletion token")
 	}
 	location := rr.Header().Get("Location")
-	if location != "/3677e35be4b1ad2d.png" {
+	if location != "/f74828a4bf77eb13e3448930800a64d6.png" {
 		t.Errorf("wrong Location header: %v", location)
 	}
 
@@ -122,6 +195,268 @@ func TestUpload(t *testing.T) {
 	}
 }
 
+func TestUploadUppercaseExtensionIsReachable(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "bundle.TAR.GZ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write([]byte{1, 2, 3, 42}); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(dispatch)
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("expected StatusFound, got %v", status)
+	}
+	location := rr.Header().Get("Location")
+	if strings.ToLower(location) != location {
+		t.Errorf("Location should be all-lowercase, got %v", location)
+	}
+
+	req, err = http.NewRequest("GET", location, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("uploaded file should be reachable at its own Location, got %v", status)
+	}
+}
+
+func TestUploadMaxDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "joconde.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dummyImageBytes := []byte{1, 2, 3, 42}
+	if _, err := part.Write(dummyImageBytes); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(kMaxDownloadsHeader, "2")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(dispatch)
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("expected StatusFound, got %v", status)
+	}
+	location := rr.Header().Get("Location")
+
+	req, err = http.NewRequest("GET", location, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+	if remaining := rr.Header().Get(kRemainingDownloadsHeader); remaining != "1" {
+		t.Errorf("expected remaining downloads 1, got %v", remaining)
+	}
+
+	req, err = http.NewRequest("GET", location, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+	if remaining := rr.Header().Get(kRemainingDownloadsHeader); remaining != "0" {
+		t.Errorf("expected remaining downloads 0, got %v", remaining)
+	}
+
+	req, err = http.NewRequest("GET", location, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("expected StatusNotFound after limit reached, got %v", status)
+	}
+}
+
+func TestUploadEncrypted(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "joconde.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	dummyImageBytes := []byte{1, 2, 3, 42}
+	if _, err := part.Write(dummyImageBytes); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(kEncryptHeader, "1")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(dispatch)
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("expected StatusFound, got %v", status)
+	}
+	location := rr.Header().Get("Location")
+	fragment := strings.SplitN(location, "#k=", 2)
+	if len(fragment) != 2 {
+		t.Fatalf("expected Location with #k= fragment, got %v", location)
+	}
+	key, err := parseEncryptionKey(fragment[1])
+	if err != nil {
+		t.Fatalf("bad encryption key in Location: %v", err)
+	}
+
+	path := fragment[0]
+	req, err = http.NewRequest("GET", path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+	blob, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if reflect.DeepEqual(blob, dummyImageBytes) {
+		t.Errorf("expected ciphertext, got plaintext bytes back")
+	}
+
+	req, err = http.NewRequest("GET", path+"?"+kEncryptionKeyQueryArg+"="+key.String(), nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+	data, err := ioutil.ReadAll(rr.Body)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !reflect.DeepEqual(data, dummyImageBytes) {
+		t.Errorf("wrong decrypted bytes, got %+v", data)
+	}
+}
+
+func TestUploadEncryptedFirstView(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "joconde.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write([]byte{1, 2, 3, 42}); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(kEncryptHeader, "1")
+	req.Header.Set(kMaxDownloadsHeader, "1")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(dispatch)
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("expected StatusFound, got %v", status)
+	}
+	path := strings.SplitN(rr.Header().Get("Location"), "#k=", 2)[0]
+
+	// The browser's initial request for the viewer page must not consume
+	// the single view, since it's the page's own follow-up fetch() that
+	// actually retrieves the ciphertext.
+	req, err = http.NewRequest("GET", path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Accept", "text/html")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK for the viewer page, got %v", status)
+	}
+	if remaining := rr.Header().Get(kRemainingDownloadsHeader); remaining != "" {
+		t.Errorf("viewer page load should not report a remaining-downloads header, got %v", remaining)
+	}
+
+	req, err = http.NewRequest("GET", path, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set("Accept", "application/octet-stream")
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK for the real content fetch, got %v", status)
+	}
+}
+
 func TestLutimUpload(t *testing.T) {
 	dir, err := ioutil.TempDir(".", "tmpstorage")
 	if err != nil {
@@ -129,6 +464,8 @@ func TestLutimUpload(t *testing.T) {
 	}
 	defer os.RemoveAll(dir)
 	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
 
 	body := new(bytes.Buffer)
 	writer := multipart.NewWriter(body)
@@ -161,7 +498,7 @@ func TestLutimUpload(t *testing.T) {
 	if !lr.Success {
 		t.Errorf("success is not true")
 	}
-	if lr.Message.Short != "3677e35be4b1ad2d.png" {
+	if lr.Message.Short != "f74828a4bf77eb13e3448930800a64d6.png" {
 		t.Errorf("wrong short: %s", lr.Message.Short)
 	}
 	if lr.Message.LifetimeDays != 42 {
@@ -174,7 +511,7 @@ func TestLutimUpload(t *testing.T) {
 		t.Errorf("empty deletion token")
 	}
 
-	url := "/3677e35be4b1ad2d.png"
+	url := "/f74828a4bf77eb13e3448930800a64d6.png"
 	req, err = http.NewRequest("GET", url, nil)
 	if err != nil {
 		log.Fatal(err)
@@ -222,3 +559,484 @@ func TestLutimUpload(t *testing.T) {
 		t.Errorf("expected StatusNotFound, got %v", status)
 	}
 }
+
+func TestUploadDedup(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+	handler := http.HandlerFunc(dispatch)
+
+	upload := func() (location, deletionToken string) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "joconde.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write([]byte{1, 2, 3, 42}); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		req, err := http.NewRequest("POST", "/", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusFound {
+			t.Errorf("expected StatusFound, got %v", status)
+		}
+		return rr.Header().Get("Location"), rr.Header().Get(kDeletionTokenHeader)
+	}
+
+	locationA, tokenA := upload()
+	locationB, tokenB := upload()
+	if locationA != locationB {
+		t.Fatalf("identical content should share a blob: %v != %v", locationA, locationB)
+	}
+	if tokenA == tokenB {
+		t.Errorf("each uploader should get its own deletion token")
+	}
+
+	req, err := http.NewRequest("DELETE", locationA, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set(kDeletionTokenHeader, tokenA)
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("expected StatusNoContent, got %v", status)
+	}
+
+	// The blob is still referenced by uploader B's entry, so it must
+	// survive uploader A's delete.
+	req, err = http.NewRequest("GET", locationA, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK (blob still shared), got %v", status)
+	}
+
+	req, err = http.NewRequest("DELETE", locationB, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	req.Header.Set(kDeletionTokenHeader, tokenB)
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNoContent {
+		t.Errorf("expected StatusNoContent, got %v", status)
+	}
+
+	req, err = http.NewRequest("GET", locationA, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("expected StatusNotFound (last entry removed), got %v", status)
+	}
+}
+
+func TestUploadDedupMaxDownloads(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+	handler := http.HandlerFunc(dispatch)
+
+	upload := func(maxDownloads string) (location string) {
+		body := new(bytes.Buffer)
+		writer := multipart.NewWriter(body)
+		part, err := writer.CreateFormFile("file", "joconde.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write([]byte{1, 2, 3, 42}); err != nil {
+			t.Fatal(err)
+		}
+		writer.Close()
+		req, err := http.NewRequest("POST", "/", body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Content-Type", writer.FormDataContentType())
+		if maxDownloads != "" {
+			req.Header.Set(kMaxDownloadsHeader, maxDownloads)
+		}
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+		if status := rr.Code; status != http.StatusFound {
+			t.Errorf("expected StatusFound, got %v", status)
+		}
+		return rr.Header().Get("Location")
+	}
+
+	// Uploader A has no view limit; uploader B shares the same bytes but
+	// caps itself at a single view.
+	locationA := upload("")
+	locationB := upload("1")
+	if locationA != locationB {
+		t.Fatalf("identical content should share a blob: %v != %v", locationA, locationB)
+	}
+
+	req, err := http.NewRequest("GET", locationB, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr := httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+
+	// B's single view must not affect A's unlimited entry.
+	req, err = http.NewRequest("GET", locationA, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK (A's entry has no view limit), got %v", status)
+	}
+}
+
+func TestArchiveBrowse(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+	*enableArchiveBrowse = true
+	defer func() { *enableArchiveBrowse = false }()
+
+	var zipBytes bytes.Buffer
+	zw := zip.NewWriter(&zipBytes)
+	member, err := zw.Create("dir/hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := member.Write([]byte("hello archive")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "bundle.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(zipBytes.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(dispatch)
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusFound {
+		t.Errorf("expected StatusFound, got %v", status)
+	}
+	location := rr.Header().Get("Location")
+
+	req, err = http.NewRequest("GET", location+"/", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+	var entries []ArchiveEntry
+	if err := json.Unmarshal(rr.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name != "dir/hello.txt" {
+		t.Fatalf("wrong archive listing: %+v", entries)
+	}
+
+	req, err = http.NewRequest("GET", location+"/dir/hello.txt", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+	if data := rr.Body.String(); data != "hello archive" {
+		t.Errorf("wrong member contents: %q", data)
+	}
+
+	req, err = http.NewRequest("GET", location+"/dir/missing.txt", nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusNotFound {
+		t.Errorf("expected StatusNotFound for missing member, got %v", status)
+	}
+}
+
+func TestArchiveBrowseRejectsOversizedMember(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+	*enableArchiveBrowse = true
+	defer func() { *enableArchiveBrowse = false }()
+	defer func(old int64) { *maxArchiveExtractedSize = old }(*maxArchiveExtractedSize)
+	*maxArchiveExtractedSize = 16
+
+	var zipBytes bytes.Buffer
+	zw := zip.NewWriter(&zipBytes)
+	member, err := zw.Create("big.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := member.Write(bytes.Repeat([]byte("x"), 64)); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "bundle.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(zipBytes.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(dispatch)
+	handler.ServeHTTP(rr, req)
+	location := rr.Header().Get("Location")
+
+	req, err = http.NewRequest("GET", location+"/big.txt", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusRequestEntityTooLarge {
+		t.Errorf("expected StatusRequestEntityTooLarge, got %v", status)
+	}
+}
+
+// getHookMetadataStore wraps a MetadataStore and runs onFirstGet once, after
+// the first Get call returns its result but before that result reaches the
+// caller, letting a test inject a write from "another request" in between a
+// caller's read and its later write-back.
+type getHookMetadataStore struct {
+	MetadataStore
+	getCount   int
+	onFirstGet func()
+}
+
+func (h *getHookMetadataStore) Get(key string) (*FileMetadata, error) {
+	meta, err := h.MetadataStore.Get(key)
+	h.getCount++
+	if h.getCount == 1 && h.onFirstGet != nil {
+		h.onFirstGet()
+	}
+	return meta, err
+}
+
+func TestArchiveBrowseDoesNotClobberConcurrentDownloadCount(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	realStore := newJSONMetadataStore(dir)
+	metaStore = realStore
+	*enableArchiveBrowse = true
+	defer func() { *enableArchiveBrowse = false }()
+
+	var zipBytes bytes.Buffer
+	zw := zip.NewWriter(&zipBytes)
+	member, err := zw.Create("hello.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := member.Write([]byte("hello archive")); err != nil {
+		t.Fatal(err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	part, err := writer.CreateFormFile("file", "bundle.zip")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := part.Write(zipBytes.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", "/", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(kMaxDownloadsHeader, "2")
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(dispatch)
+	handler.ServeHTTP(rr, req)
+	location := rr.Header().Get("Location")
+	name := strings.TrimPrefix(location, "/")
+
+	// Deterministically reproduce the interleaving archiveBrowse must survive:
+	// its first, unlocked metadata read races a recordDownload that lands
+	// entirely in between that read and archiveBrowse's later write-back.
+	// onFirstGet fires right after archiveBrowse's initial Get captures its
+	// (soon to be stale) copy, and runs recordDownload to completion before
+	// archiveBrowse ever gets a chance to write anything.
+	decremented := false
+	metaStore = &getHookMetadataStore{
+		MetadataStore: realStore,
+		onFirstGet: func() {
+			decremented = true
+			if _, _, err := recordDownload(name); err != nil {
+				t.Fatal(err)
+			}
+		},
+	}
+	defer func() { metaStore = realStore }()
+
+	req, err = http.NewRequest("GET", location+"/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("expected StatusOK, got %v", status)
+	}
+	if !decremented {
+		t.Fatal("onFirstGet hook never fired, test is not exercising the intended race")
+	}
+
+	meta, err := realStore.Get(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(meta.Uploads) != 1 || meta.Uploads[0].DownloadsRemaining != 1 {
+		t.Errorf("archiveBrowse's cache write-back clobbered the concurrent download-count decrement: %+v", meta.Uploads)
+	}
+}
+
+func TestPomfUpload(t *testing.T) {
+	dir, err := ioutil.TempDir(".", "tmpstorage")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	*storageRoot = dir
+	backend = newLocalFSBackend(dir)
+	metaStore = newJSONMetadataStore(dir)
+
+	body := new(bytes.Buffer)
+	writer := multipart.NewWriter(body)
+	firstBytes := []byte{1, 2, 3, 42}
+	secondBytes := []byte{9, 9, 9}
+	for _, content := range [][]byte{firstBytes, secondBytes} {
+		part, err := writer.CreateFormFile("files[]", "joconde.png")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := part.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	writer.Close()
+	req, err := http.NewRequest("POST", "/upload.php", body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Host = "files.example.com"
+	rr := httptest.NewRecorder()
+	handler := http.HandlerFunc(dispatch)
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+
+	var reply pomfUploadReply
+	if err := json.Unmarshal(rr.Body.Bytes(), &reply); err != nil {
+		t.Fatal(err)
+	}
+	if !reply.Success {
+		t.Errorf("success is not true")
+	}
+	if len(reply.Files) != 2 {
+		t.Fatalf("expected 2 files, got %d", len(reply.Files))
+	}
+	for _, f := range reply.Files {
+		if f.Hash == "" || f.Size == 0 {
+			t.Errorf("missing hash/size in %+v", f)
+		}
+		if !strings.HasPrefix(f.URL, "http://files.example.com/") {
+			t.Errorf("expected absolute URL, got %s", f.URL)
+		}
+	}
+
+	req, err = http.NewRequest("GET", "/upload.php", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rr = httptest.NewRecorder()
+	handler.ServeHTTP(rr, req)
+	if status := rr.Code; status != http.StatusOK {
+		t.Errorf("expected StatusOK, got %v", status)
+	}
+	if !strings.Contains(rr.Body.String(), `"max_upload_size"`) {
+		t.Errorf("/upload.php GET should contain max_upload_size, got %s", rr.Body.String())
+	}
+}
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// jsonMetadataStore keeps each file's metadata as a small JSON file under
+// <root>/meta/<key>.json. Unlike xattrMetadataStore, this works on any
+// filesystem - tmpfs without xattr support, some NFS/CIFS mounts, macOS
+// default configs - at the cost of one extra small file per upload.
+type jsonMetadataStore struct {
+	root string
+}
+
+func newJSONMetadataStore(root string) *jsonMetadataStore {
+	return &jsonMetadataStore{root: root}
+}
+
+func (s *jsonMetadataStore) metaDir() string {
+	return filepath.Join(s.root, "meta")
+}
+
+func (s *jsonMetadataStore) path(key string) string {
+	return filepath.Join(s.metaDir(), key+".json")
+}
+
+func (s *jsonMetadataStore) Get(key string) (*FileMetadata, error) {
+	raw, err := ioutil.ReadFile(s.path(key))
+	if err != nil {
+		return nil, err
+	}
+	meta := &FileMetadata{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+// Put writes via a temp file and rename rather than straight to s.path(key),
+// so a crash or power loss mid-write can't leave behind a half-written
+// FileMetadata - which, since one file now holds every deduped uploader's
+// delete token, expiry and download budget (see UploadEntry), would wipe out
+// all of their state at once rather than just this one Put.
+func (s *jsonMetadataStore) Put(key string, meta *FileMetadata) error {
+	if err := os.MkdirAll(s.metaDir(), 0750); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(s.metaDir(), key+".json.tmp-*")
+	if err != nil {
+		return err
+	}
+	tmpPath := tmp.Name()
+	defer os.Remove(tmpPath)
+	if _, err := tmp.Write(raw); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmpPath, 0640); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, s.path(key))
+}
+
+func (s *jsonMetadataStore) Delete(key string) error {
+	return os.Remove(s.path(key))
+}
+
+func (s *jsonMetadataStore) List() ([]string, error) {
+	entries, err := ioutil.ReadDir(s.metaDir())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	keys := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		if entry.IsDir() || strings.Contains(entry.Name(), ".json.tmp-") {
+			continue
+		}
+		keys = append(keys, strings.TrimSuffix(entry.Name(), ".json"))
+	}
+	return keys, nil
+}
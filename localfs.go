@@ -0,0 +1,57 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+// localFSBackend stores files directly on a local (or network) filesystem.
+// This is improut's original storage model, preserved as the default
+// backend.
+type localFSBackend struct {
+	root string
+}
+
+func newLocalFSBackend(root string) *localFSBackend {
+	return &localFSBackend{root: root}
+}
+
+func (b *localFSBackend) path(key string) string {
+	return filepath.Join(b.root, key)
+}
+
+func (b *localFSBackend) Put(key string, r io.Reader) (int64, error) {
+	dst, err := os.Create(b.path(key))
+	if err != nil {
+		return 0, err
+	}
+	defer dst.Close()
+	return io.Copy(dst, r)
+}
+
+func (b *localFSBackend) Get(key string) (io.ReadSeekCloser, error) {
+	return os.Open(b.path(key))
+}
+
+func (b *localFSBackend) Delete(key string) error {
+	return os.Remove(b.path(key))
+}
+
+func (b *localFSBackend) Exists(key string) (bool, error) {
+	_, err := os.Stat(b.path(key))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (b *localFSBackend) ServeFile(key string, w http.ResponseWriter, r *http.Request) {
+	if *xAccel == "" {
+		http.ServeFile(w, r, b.path(key))
+		return
+	}
+	w.Header().Set("X-Accel-Redirect", *xAccel+"/"+key)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+var errUnknownMetadataStore = errors.New("unknown metadata store")
+var errXattrRequiresLocalFS = errors.New("xattr metadata store requires -backend=localfs; pass -metadata=json instead")
+
+// UploadEntry is one uploader's claim on a stored blob. Content-addressed
+// naming means two uploads of the same bytes share a single blob, so each
+// uploader's deletion token and expiry are tracked separately here instead
+// of clobbering each other: the blob itself is only unlinked once its last
+// UploadEntry is gone, see deleteFile and checkExpired.
+type UploadEntry struct {
+	DeleteKey string    `json:"delete_key"`
+	Expiry    time.Time `json:"expiry,omitempty"`
+	CreatedAt time.Time `json:"uploaded_at"`
+	// MaxDownloads is the view limit this particular upload was made
+	// with, 0 meaning unlimited. DownloadsRemaining counts down from
+	// MaxDownloads as the shared blob is served; this entry is dropped
+	// once it reaches zero. It lives here rather than on FileMetadata so
+	// that deduped uploads of the same content each keep their own
+	// independent view budget, see recordDownload.
+	MaxDownloads       int `json:"max_downloads,omitempty"`
+	DownloadsRemaining int `json:"downloads_remaining,omitempty"`
+}
+
+// FileMetadata holds everything improut needs to know about a stored blob
+// beyond its bytes: the uploaders that share it, and a few details useful
+// for serving it back correctly.
+type FileMetadata struct {
+	SHA256Sum        string `json:"sha256sum"`
+	MimeType         string `json:"mimetype"`
+	Size             int64  `json:"size"`
+	OriginalFilename string `json:"original_filename"`
+	// Encrypted reports whether the stored bytes are nonce||ciphertext
+	// rather than the original content; the decryption key itself is
+	// never persisted, see encryption.go.
+	Encrypted bool `json:"encrypted,omitempty"`
+	// Uploads is the refcount: one entry per uploader currently sharing
+	// this blob. Never empty for metadata that's actually persisted.
+	Uploads []UploadEntry `json:"uploads"`
+	// ArchiveEntries caches the result of listing a browsable archive
+	// (see archive.go), so repeated listing requests don't have to
+	// re-read and re-parse the whole archive. Nil until the first list.
+	ArchiveEntries []ArchiveEntry `json:"archive_entries,omitempty"`
+}
+
+// MetadataStore persists FileMetadata for stored files, independently of
+// where the file bytes themselves live. This is what lets expiry and the
+// deletion token work on filesystems without xattr support (tmpfs without
+// the right mount options, some NFS/CIFS mounts, S3, macOS defaults).
+type MetadataStore interface {
+	Get(key string) (*FileMetadata, error)
+	Put(key string, meta *FileMetadata) error
+	Delete(key string) error
+	// List returns the keys of every file that currently has metadata.
+	List() ([]string, error)
+}
+
+// metaStore is the MetadataStore selected by -metadata at startup.
+var metaStore MetadataStore
+
+func newMetadataStore() (MetadataStore, error) {
+	switch *metadataStoreFlag {
+	case "xattr":
+		// xattrs are attached to a local file, which only the localfs
+		// backend ever creates; with any other backend this would
+		// silently fail on every single upload.
+		if *storageBackendFlag != "localfs" {
+			return nil, errXattrRequiresLocalFS
+		}
+		return newXattrMetadataStore(*storageRoot), nil
+	case "json":
+		return newJSONMetadataStore(*storageRoot), nil
+	default:
+		return nil, errUnknownMetadataStore
+	}
+}
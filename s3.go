@@ -0,0 +1,135 @@
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// s3Backend stores files in an S3-compatible object store.
+type s3Backend struct {
+	bucket   string
+	client   *s3.S3
+	uploader *s3manager.Uploader
+}
+
+func newS3Backend(bucket, region, endpoint string, forcePathStyle bool) (*s3Backend, error) {
+	cfg := aws.NewConfig().WithRegion(region)
+	if endpoint != "" {
+		cfg = cfg.WithEndpoint(endpoint).WithS3ForcePathStyle(forcePathStyle)
+	}
+	sess, err := session.NewSession(cfg)
+	if err != nil {
+		return nil, err
+	}
+	return &s3Backend{
+		bucket:   bucket,
+		client:   s3.New(sess),
+		uploader: s3manager.NewUploader(sess),
+	}, nil
+}
+
+func (b *s3Backend) Put(key string, r io.Reader) (int64, error) {
+	// s3manager needs to know the size ahead of time for multipart
+	// decisions, but improut only has a stream; buffering through a
+	// temp file keeps Put's signature identical across backends.
+	tmp, err := ioutil.TempFile("", "improut-s3-put-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+	size, err := io.Copy(tmp, r)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	_, err = b.uploader.Upload(&s3manager.UploadInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+		Body:   tmp,
+	})
+	return size, err
+}
+
+// s3Object wraps a downloaded object body in a seekable, self-cleaning
+// temp file, since the S3 SDK only hands back an io.ReadCloser.
+type s3Object struct {
+	*os.File
+}
+
+func (o s3Object) Close() error {
+	defer os.Remove(o.File.Name())
+	return o.File.Close()
+}
+
+func (b *s3Backend) download(key string) (*os.File, error) {
+	out, err := b.client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer out.Body.Close()
+	tmp, err := ioutil.TempFile("", "improut-s3-get-")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(tmp, out.Body); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		os.Remove(tmp.Name())
+		return nil, err
+	}
+	return tmp, nil
+}
+
+func (b *s3Backend) Get(key string) (io.ReadSeekCloser, error) {
+	f, err := b.download(key)
+	if err != nil {
+		return nil, err
+	}
+	return s3Object{f}, nil
+}
+
+func (b *s3Backend) Delete(key string) error {
+	_, err := b.client.DeleteObject(&s3.DeleteObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	return err
+}
+
+func (b *s3Backend) Exists(key string) (bool, error) {
+	_, err := b.client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(b.bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return false, nil
+	}
+	return true, nil
+}
+
+func (b *s3Backend) ServeFile(key string, w http.ResponseWriter, r *http.Request) {
+	f, err := b.download(key)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	http.ServeContent(w, r, key, time.Time{}, f)
+}
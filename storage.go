@@ -0,0 +1,45 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+var errUnknownBackend = errors.New("unknown storage backend")
+
+// StorageBackend abstracts where uploaded file bytes actually live, so
+// improut can target local disk, object storage, or anything else that
+// satisfies this interface without touching the upload/delete/expiry logic.
+// Metadata (expiry, deletion token, ...) is handled separately by a
+// MetadataStore, since the two concerns vary independently: a localfs
+// deployment might still want JSON metadata instead of xattrs, and an S3
+// deployment has no xattrs to begin with.
+type StorageBackend interface {
+	// Put streams r to key, returning the number of bytes written.
+	Put(key string, r io.Reader) (int64, error)
+	// Get opens the content stored at key for reading.
+	Get(key string) (io.ReadSeekCloser, error)
+	// Delete removes the content stored at key.
+	Delete(key string) error
+	// Exists reports whether key currently has content.
+	Exists(key string) (bool, error)
+	// ServeFile writes the content at key to w, following whatever
+	// request/response conventions the backend supports (range requests,
+	// X-Accel-Redirect, ...).
+	ServeFile(key string, w http.ResponseWriter, r *http.Request)
+}
+
+// backend is the StorageBackend selected by -backend at startup.
+var backend StorageBackend
+
+func newBackend() (StorageBackend, error) {
+	switch *storageBackendFlag {
+	case "localfs":
+		return newLocalFSBackend(*storageRoot), nil
+	case "s3":
+		return newS3Backend(*s3Bucket, *s3Region, *s3Endpoint, *s3ForcePathStyle)
+	default:
+		return nil, errUnknownBackend
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import "fmt"
+
+// encryptedViewerTemplate is served instead of the raw (encrypted) bytes
+// when a browser requests an encrypted file. The server never sees the URL
+// fragment carrying the key, so decryption has to happen here, client-side,
+// with the Web Crypto API.
+const encryptedViewerTemplate = `<!doctype html>
+<html><head><meta charset="utf-8"><title>improut</title></head>
+<body style="margin:0;display:flex;align-items:center;justify-content:center;min-height:100vh;background:#111">
+<div id="improut-content" style="color:#eee;font-family:sans-serif">Decrypting…</div>
+<script>
+(async () => {
+	const el = document.getElementById("improut-content");
+	const match = location.hash.match(/k=([^&]+)/);
+	if (!match) {
+		el.textContent = "Missing decryption key in URL fragment.";
+		return;
+	}
+	try {
+		let b64 = match[1].replace(/-/g, "+").replace(/_/g, "/");
+		while (b64.length %% 4) b64 += "=";
+		const rawKey = Uint8Array.from(atob(b64), c => c.charCodeAt(0));
+		const key = await crypto.subtle.importKey("raw", rawKey, "AES-GCM", false, ["decrypt"]);
+		const resp = await fetch(location.pathname, {headers: {"Accept": "application/octet-stream"}});
+		const blob = new Uint8Array(await resp.arrayBuffer());
+		const iv = blob.slice(0, 12);
+		const ciphertext = blob.slice(12);
+		const plaintext = await crypto.subtle.decrypt({name: "AES-GCM", iv}, key, ciphertext);
+		const mimeType = %q;
+		const url = URL.createObjectURL(new Blob([plaintext], {type: mimeType}));
+		if (mimeType.startsWith("image/")) {
+			el.outerHTML = '<img src="' + url + '" style="max-width:100vw;max-height:100vh">';
+		} else {
+			location.replace(url);
+		}
+	} catch (e) {
+		el.textContent = "Decryption failed: " + e;
+	}
+})();
+</script>
+</body></html>`
+
+func encryptedViewerHTML(mimeType string) string {
+	return fmt.Sprintf(encryptedViewerTemplate, mimeType)
+}
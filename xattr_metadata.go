@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/xattr"
+)
+
+// xattrMetaField is the single extended attribute each file's FileMetadata
+// is marshalled into, as JSON.
+const xattrMetaField = "user.imp.meta"
+
+// xattrMetadataStore keeps each file's metadata in a local extended
+// attribute. This is improut's original metadata model, preserved as the
+// default store. It only works on filesystems that support xattrs.
+type xattrMetadataStore struct {
+	root string
+}
+
+func newXattrMetadataStore(root string) *xattrMetadataStore {
+	return &xattrMetadataStore{root: root}
+}
+
+func (s *xattrMetadataStore) path(key string) string {
+	return filepath.Join(s.root, key)
+}
+
+func (s *xattrMetadataStore) Get(key string) (*FileMetadata, error) {
+	raw, err := xattr.Get(s.path(key), xattrMetaField)
+	if err != nil {
+		return nil, err
+	}
+	meta := &FileMetadata{}
+	if err := json.Unmarshal(raw, meta); err != nil {
+		return nil, err
+	}
+	return meta, nil
+}
+
+func (s *xattrMetadataStore) Put(key string, meta *FileMetadata) error {
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	return xattr.Set(s.path(key), xattrMetaField, raw)
+}
+
+func (s *xattrMetadataStore) Delete(key string) error {
+	return xattr.Remove(s.path(key), xattrMetaField)
+}
+
+func (s *xattrMetadataStore) List() ([]string, error) {
+	var keys []string
+	err := filepath.Walk(s.root, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return nil
+		}
+		keys = append(keys, filepath.Base(path))
+		return nil
+	})
+	return keys, err
+}